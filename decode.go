@@ -0,0 +1,91 @@
+/**
+ * @license
+ * Copyright 2018 Telefónica Investigación y Desarrollo, S.A.U
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nfqueue
+
+import (
+	"net"
+
+	"github.com/eclipsesatcom/nfqueue/decode"
+	"github.com/google/gopacket"
+)
+
+// Decode lazily parses Buffer as an IPv4 or IPv6 packet using gopacket,
+// caching the result so repeated calls (and SrcIP, DstIP, L4, Rewrite) only
+// pay the parsing cost once per packet.
+func (p *Packet) Decode() (*decode.Packet, error) {
+	if p.decoded != nil {
+		return p.decoded, nil
+	}
+	d, err := decode.Decode(p.Buffer)
+	if err != nil {
+		return nil, err
+	}
+	p.decoded = d
+	return d, nil
+}
+
+// SrcIP decodes the packet (if not already decoded) and returns its
+// network-layer source address.
+func (p *Packet) SrcIP() (net.IP, error) {
+	d, err := p.Decode()
+	if err != nil {
+		return nil, err
+	}
+	return d.SrcIP(), nil
+}
+
+// DstIP decodes the packet (if not already decoded) and returns its
+// network-layer destination address.
+func (p *Packet) DstIP() (net.IP, error) {
+	d, err := p.Decode()
+	if err != nil {
+		return nil, err
+	}
+	return d.DstIP(), nil
+}
+
+// L4 decodes the packet (if not already decoded) and returns its transport
+// layer (TCP, UDP, ICMPv4, ...), or nil if none was recognized.
+func (p *Packet) L4() (gopacket.TransportLayer, error) {
+	d, err := p.Decode()
+	if err != nil {
+		return nil, err
+	}
+	return d.L4(), nil
+}
+
+// Rewrite decodes the packet, hands its parsed layers to fn for mutation,
+// recomputes IP/TCP/UDP checksums and length fields on the buffer fn
+// returns, and applies the result via Modify. This is the common pattern for
+// NAT-like or DPI-style userspace rewriting, so callers no longer need to
+// reimplement checksum fixups on top of the raw Buffer.
+func (p *Packet) Rewrite(fn func(pkt gopacket.Packet) ([]byte, error)) error {
+	d, err := p.Decode()
+	if err != nil {
+		return err
+	}
+	buf, err := fn(d.Packet)
+	if err != nil {
+		return err
+	}
+	final, err := decode.RecomputeChecksums(buf)
+	if err != nil {
+		return err
+	}
+	return p.Modify(final)
+}
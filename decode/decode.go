@@ -0,0 +1,135 @@
+/**
+ * @license
+ * Copyright 2018 Telefónica Investigación y Desarrollo, S.A.U
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package decode parses the raw L3 buffers handed out by nfqueue into
+// gopacket layers, so that callers no longer have to reimplement IPv4/IPv6
+// and TCP/UDP/ICMP parsing on top of Packet.Buffer themselves.
+package decode
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Packet wraps a gopacket.Packet decoded from a raw IPv4 or IPv6 buffer
+// delivered by netfilter (there is no link layer, since nfqueue packets are
+// already stripped of their Ethernet framing), with convenience accessors
+// for the fields policy code needs most often.
+type Packet struct {
+	gopacket.Packet
+}
+
+// Decode parses buffer as an IPv4 or IPv6 packet. Every layer is decoded
+// before Decode returns, since checking for a decoding error walks the whole
+// packet, so a malformed packet is reported as an error here.
+func Decode(buffer []byte) (*Packet, error) {
+	pkt, err := newPacket(buffer, gopacket.DecodeOptions{Lazy: true})
+	if err != nil {
+		return nil, err
+	}
+	return &Packet{Packet: pkt}, nil
+}
+
+func newPacket(buffer []byte, opts gopacket.DecodeOptions) (gopacket.Packet, error) {
+	if len(buffer) == 0 {
+		return nil, fmt.Errorf("Error decoding packet: empty buffer")
+	}
+
+	var firstLayer gopacket.LayerType
+	switch buffer[0] >> 4 {
+	case 4:
+		firstLayer = layers.LayerTypeIPv4
+	case 6:
+		firstLayer = layers.LayerTypeIPv6
+	default:
+		return nil, fmt.Errorf("Error decoding packet: unknown IP version %d", buffer[0]>>4)
+	}
+
+	pkt := gopacket.NewPacket(buffer, firstLayer, opts)
+	if err := pkt.ErrorLayer(); err != nil {
+		return nil, fmt.Errorf("Error decoding packet: %v", err.Error())
+	}
+	return pkt, nil
+}
+
+// SrcIP returns the packet's network-layer source address, or nil if the
+// packet has no recognized network layer.
+func (p *Packet) SrcIP() net.IP {
+	nl := p.NetworkLayer()
+	if nl == nil {
+		return nil
+	}
+	return net.IP(nl.NetworkFlow().Src().Raw())
+}
+
+// DstIP returns the packet's network-layer destination address, or nil if
+// the packet has no recognized network layer.
+func (p *Packet) DstIP() net.IP {
+	nl := p.NetworkLayer()
+	if nl == nil {
+		return nil
+	}
+	return net.IP(nl.NetworkFlow().Dst().Raw())
+}
+
+// L4 returns the packet's transport layer (TCP, UDP, ICMPv4, ...), or nil if
+// none was recognized.
+func (p *Packet) L4() gopacket.TransportLayer {
+	return p.TransportLayer()
+}
+
+// RecomputeChecksums re-decodes buffer and re-serializes it with its
+// IP/TCP/UDP checksums and length fields recomputed. Callers that hand-build
+// a replacement buffer (e.g. after rewriting an address or a payload) need
+// this before handing it back to the kernel, since the kernel does not
+// recompute checksums for a Modify'd packet.
+func RecomputeChecksums(buffer []byte) ([]byte, error) {
+	pkt, err := newPacket(buffer, gopacket.DecodeOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	if tcp, ok := pkt.TransportLayer().(*layers.TCP); ok {
+		if err := tcp.SetNetworkLayerForChecksum(pkt.NetworkLayer()); err != nil {
+			return nil, fmt.Errorf("Error recomputing TCP checksum: %v", err)
+		}
+	}
+	if udp, ok := pkt.TransportLayer().(*layers.UDP); ok {
+		if err := udp.SetNetworkLayerForChecksum(pkt.NetworkLayer()); err != nil {
+			return nil, fmt.Errorf("Error recomputing UDP checksum: %v", err)
+		}
+	}
+
+	var serializable []gopacket.SerializableLayer
+	for _, l := range pkt.Layers() {
+		s, ok := l.(gopacket.SerializableLayer)
+		if !ok {
+			return nil, fmt.Errorf("Error recomputing checksums: layer %s is not serializable", l.LayerType())
+		}
+		serializable = append(serializable, s)
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}
+	if err := gopacket.SerializeLayers(buf, opts, serializable...); err != nil {
+		return nil, fmt.Errorf("Error recomputing checksums: %v", err)
+	}
+	return buf.Bytes(), nil
+}
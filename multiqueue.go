@@ -0,0 +1,101 @@
+/**
+ * @license
+ * Copyright 2018 Telefónica Investigación y Desarrollo, S.A.U
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+//go:build nfqueue_cgo
+
+package nfqueue
+
+/*
+#include <sched.h>
+
+static int nfqueue_set_affinity(int cpu) {
+	cpu_set_t set;
+	CPU_ZERO(&set);
+	CPU_SET(cpu, &set);
+	return sched_setaffinity(0, sizeof(cpu_set_t), &set);
+}
+*/
+import "C"
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+)
+
+// pinToCPU locks the calling goroutine to its current OS thread and pins
+// that thread to cpu via sched_setaffinity.
+func pinToCPU(cpu int) error {
+	runtime.LockOSThread()
+	if C.nfqueue_set_affinity(C.int(cpu)) != 0 {
+		return fmt.Errorf("Error pinning worker to CPU %d", cpu)
+	}
+	return nil
+}
+
+// MultiQueue binds a contiguous range of netfilter queue IDs, one per
+// worker, so that iptables' --queue-balance directive can steer packets to
+// the queue matching the CPU they arrived on. This is the standard per-CPU
+// scaling pattern for nfqueue-based firewalls.
+type MultiQueue struct {
+	Base   uint16
+	queues []*Queue
+}
+
+// NewMultiQueue creates n Queue instances bound to queue IDs base..base+n-1,
+// all sharing the same handler and configuration.
+func NewMultiQueue(base uint16, n int, handler PacketHandler, cfg *QueueConfig) *MultiQueue {
+	m := &MultiQueue{Base: base}
+	for i := 0; i < n; i++ {
+		m.queues = append(m.queues, NewQueue(base+uint16(i), handler, cfg))
+	}
+	return m
+}
+
+// Run starts every underlying queue on its own goroutine, pinning each one
+// to the CPU matching its position in the range when PerCPUAffinity is
+// enabled, and blocks until every queue has returned. The first queue to
+// return an error cancels the others via a child context, so a caller never
+// sees Run return while sibling queues (and their kernel queue
+// registrations) are still running in the background.
+func (m *MultiQueue) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errCh := make(chan error, len(m.queues))
+	for i, q := range m.queues {
+		cpu, q := i, q
+		go func() {
+			if q.cfg.PerCPUAffinity {
+				if err := pinToCPU(cpu); err != nil {
+					errCh <- err
+					return
+				}
+			}
+			errCh <- q.Run(ctx)
+		}()
+	}
+
+	var firstErr error
+	for range m.queues {
+		if err := <-errCh; err != nil && firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+	return firstErr
+}
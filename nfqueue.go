@@ -15,6 +15,8 @@
  * limitations under the License.
  */
 
+//go:build nfqueue_cgo
+
 package nfqueue
 
 /*
@@ -27,131 +29,94 @@ package nfqueue
 import "C"
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"net"
+	"sync"
 	"unsafe"
 )
 
-// PacketHandler is an interface to handle a packet retrieved by netfilter.
-type PacketHandler interface {
-	Handle(p *Packet)
+// Accept the packet.
+func (p *Packet) Accept() error {
+	return p.setVerdict(C.NF_ACCEPT, 0, nil)
 }
 
-// PacketMeta contains metadata about a packet
-type PacketMeta struct {
-	HasUID     bool
-	HasGID     bool
-	UID        uint32
-	GID        uint32
-	InDev      uint32
-	OutDev     uint32
-	PhysInDev  uint32
-	PhysOutDev uint32
-	NFMark     uint32
-	HWAddr     []byte
+// Drop the packet.
+func (p *Packet) Drop() error {
+	return p.setVerdict(C.NF_DROP, 0, nil)
 }
 
-// InDevName returns the name of the input interface
-func (m *PacketMeta) InDevName() string {
-	iface, err := net.InterfaceByIndex(int(m.InDev))
-	if err != nil {
-		return ""
-	}
-	return iface.Name
+// Repeat makes the packet re-traverse the ruleset from the start (NF_REPEAT).
+// This is mainly useful after policy changes that should apply to packets
+// already in flight.
+func (p *Packet) Repeat() error {
+	return p.setVerdict(C.NF_REPEAT, 0, nil)
 }
 
-// OutDevName returns the name of the output interface
-func (m *PacketMeta) OutDevName() string {
-	iface, err := net.InterfaceByIndex(int(m.OutDev))
-	if err != nil {
-		return ""
-	}
-	return iface.Name
+// Stolen tells the kernel that userspace has taken ownership of the packet
+// (NF_STOLEN), e.g. to hold it for a later asynchronous decision. A stolen
+// packet still counts against the kernel queue's length, so it must
+// eventually be accounted for (for instance by requeuing it once the
+// decision is made) or the queue will fill up; SetQueueMaxlenBypass can be
+// used to drain a queue that got stuck this way without restarting it.
+func (p *Packet) Stolen() error {
+	return p.setVerdict(C.NF_STOLEN, 0, nil)
 }
 
-// PhysInDevName returns the name of the physical input interface
-func (m *PacketMeta) PhysInDevName() string {
-	iface, err := net.InterfaceByIndex(int(m.PhysInDev))
-	if err != nil {
-		return ""
-	}
-	return iface.Name
+// Requeue hands the packet off to another nfqueue queue, per the
+// NF_QUEUE | (queueID << 16) verdict encoding from the nfnetlink_queue
+// protocol. This lets a pipeline chain multiple queues together, each
+// handling one stage of processing.
+func (p *Packet) Requeue(queueID uint16) error {
+	verdict := C.u_int32_t(C.NF_QUEUE) | (C.u_int32_t(queueID) << 16)
+	return p.setVerdict(verdict, 0, nil)
 }
 
-// PhysOutDevName returns the name of the physical output interface
-func (m *PacketMeta) PhysOutDevName() string {
-	iface, err := net.InterfaceByIndex(int(m.PhysOutDev))
-	if err != nil {
-		return ""
-	}
-	return iface.Name
+// Modify the packet with a new buffer.
+func (p *Packet) Modify(buffer []byte) error {
+	return p.setVerdict(C.NF_ACCEPT, C.u_int32_t(len(buffer)), (*C.uchar)(unsafe.Pointer(&buffer[0])))
 }
 
-// MACAddr returns the human-readable value of the MAC address for the packet source
-func (m *PacketMeta) MACAddr() string {
-	return fmt.Sprintf(
-		"%02X:%02X:%02X:%02X:%02X:%02X",
-		m.HWAddr[0], m.HWAddr[1], m.HWAddr[2], m.HWAddr[3], m.HWAddr[4], m.HWAddr[5],
-	)
+// AcceptWithMark accepts the packet and sets its NFMark to mark.
+func (p *Packet) AcceptWithMark(mark uint32) error {
+	return p.setVerdictMark(C.NF_ACCEPT, C.u_int32_t(mark), 0, nil)
 }
 
-// Packet struct provides the packet data and methods to accept, drop or modify the packet.
-type Packet struct {
-	Buffer []byte
-	Meta   *PacketMeta
-	id     uint32
-	q      *Queue
+// RepeatWithMark re-queues the packet to the head of the same ruleset (NF_REPEAT)
+// and sets its NFMark to mark, so a later rule can match on it.
+func (p *Packet) RepeatWithMark(mark uint32) error {
+	return p.setVerdictMark(C.NF_REPEAT, C.u_int32_t(mark), 0, nil)
 }
 
-// Accept the packet.
-func (p *Packet) Accept() error {
-	return p.setVerdict(C.NF_ACCEPT, 0, nil)
-}
-
-// Drop the packet.
-func (p *Packet) Drop() error {
-	return p.setVerdict(C.NF_DROP, 0, nil)
-}
-
-// Modify the packet with a new buffer.
-func (p *Packet) Modify(buffer []byte) error {
-	return p.setVerdict(C.NF_ACCEPT, C.u_int32_t(len(buffer)), (*C.uchar)(unsafe.Pointer(&buffer[0])))
+// ModifyWithMark modifies the packet with a new buffer and sets its NFMark to mark.
+func (p *Packet) ModifyWithMark(buffer []byte, mark uint32) error {
+	return p.setVerdictMark(C.NF_ACCEPT, C.u_int32_t(mark), C.u_int32_t(len(buffer)), (*C.uchar)(unsafe.Pointer(&buffer[0])))
 }
 
 func (p *Packet) setVerdict(verdict, len C.u_int32_t, buffer *C.uchar) error {
+	if p.q.cfg.BatchVerdicts && len == 0 {
+		return p.q.queueBatchVerdict(p.id, verdict)
+	}
+	if err := p.q.flushBatch(); err != nil {
+		return err
+	}
 	if C.nfq_set_verdict(p.q.qh, C.u_int32_t(p.id), verdict, len, buffer) < 0 {
 		return fmt.Errorf("Error setting verdict %d for packet %d", verdict, p.id)
 	}
 	return nil
 }
 
-// QueueFlag configures the kernel queue.
-type QueueFlag C.uint32_t
-
-const (
-	// FailOpen (requires Linux kernel >= 3.6): the kernel will accept the packets if the kernel queue gets full.
-	// If this flag is not set, the default action in this case is to drop packets.
-	FailOpen QueueFlag = (1 << 0)
-	// Conntrack (requires Linux kernel >= 3.6): the kernel will include the Connection Tracking system information.
-	Conntrack QueueFlag = (1 << 1)
-	// GSO (requires Linux kernel >= 3.10): the kernel will not normalize offload packets,
-	// i.e. your application will need to be able to handle packets larger than the mtu.
-	GSO QueueFlag = (1 << 2)
-	// UIDGid makes the kernel dump UID and GID of the socket to which each packet belongs.
-	UIDGid QueueFlag = (1 << 3)
-	// Secctx makes the kernel dump security context of the socket to which each packet belongs.
-	Secctx QueueFlag = (1 << 4)
-)
-
-// QueueConfig contains optional configuration parameters to initialize a queue.
-type QueueConfig struct {
-	MaxPackets uint32
-	QueueFlags []QueueFlag
-	BufferSize uint32
+func (p *Packet) setVerdictMark(verdict, mark, len C.u_int32_t, buffer *C.uchar) error {
+	if err := p.q.flushBatch(); err != nil {
+		return err
+	}
+	if C.nfq_set_verdict2(p.q.qh, C.u_int32_t(p.id), verdict, mark, len, buffer) < 0 {
+		return fmt.Errorf("Error setting verdict %d (mark %d) for packet %d", verdict, mark, p.id)
+	}
+	return nil
 }
 
-// Queue represents a netfilter queue with methods to start processing the packets (Run) and to stop
+// Queue represents a netfilter queue with a Run method that processes packets until its context is canceled
 type Queue struct {
 	ID      uint16
 	handler PacketHandler
@@ -159,6 +124,110 @@ type Queue struct {
 	h       *C.struct_nfq_handle
 	qh      *C.struct_nfq_q_handle
 	fd      C.int
+
+	closeOnce sync.Once
+
+	batchMu      sync.Mutex
+	batchPending bool
+	batchVerdict C.u_int32_t
+	batchMaxID   uint32
+	batchCount   int
+
+	packetCh  chan *Packet
+	workersWG sync.WaitGroup
+}
+
+// dispatch is called for every packet delivered by the kernel. When Workers
+// is configured it hands the packet off to the worker pool instead of
+// invoking the handler inline, so that a slow PacketHandler.Handle does not
+// stall the netlink read thread.
+func (q *Queue) dispatch(id uint32, buffer []byte, meta *PacketMeta) {
+	p := &Packet{Buffer: buffer, Meta: meta, id: id, q: q}
+	if q.cfg.Workers > 0 {
+		q.packetCh <- p
+		return
+	}
+	q.handler.Handle(p)
+}
+
+// startWorkers launches the worker pool configured via QueueConfig.Workers.
+// It is a no-op when Workers is zero.
+func (q *Queue) startWorkers() {
+	if q.cfg.Workers <= 0 {
+		return
+	}
+	q.packetCh = make(chan *Packet, q.cfg.Workers*64)
+	for i := 0; i < q.cfg.Workers; i++ {
+		worker := i
+		q.workersWG.Add(1)
+		go func() {
+			defer q.workersWG.Done()
+			if q.cfg.PerCPUAffinity {
+				if err := pinToCPU(worker); err != nil {
+					return
+				}
+			}
+			for p := range q.packetCh {
+				q.handler.Handle(p)
+			}
+		}()
+	}
+}
+
+// stopWorkers closes the packet channel and waits for every worker to drain
+// it. It is a no-op when Workers is zero.
+func (q *Queue) stopWorkers() {
+	if q.cfg.Workers <= 0 {
+		return
+	}
+	close(q.packetCh)
+	q.workersWG.Wait()
+}
+
+// queueBatchVerdict buffers a verdict for later flushing instead of issuing it
+// immediately. A packet whose verdict differs from the one already pending
+// forces a flush of the existing batch first, since nfq_set_verdict_batch
+// applies a single verdict to every ID up to and including the one given.
+func (q *Queue) queueBatchVerdict(id uint32, verdict C.u_int32_t) error {
+	q.batchMu.Lock()
+	defer q.batchMu.Unlock()
+
+	if q.batchPending && q.batchVerdict != verdict {
+		if err := q.flushBatchLocked(); err != nil {
+			return err
+		}
+	}
+
+	q.batchPending = true
+	q.batchVerdict = verdict
+	q.batchMaxID = id
+	q.batchCount++
+
+	if q.cfg.BatchWindow > 0 && q.batchCount >= q.cfg.BatchWindow {
+		return q.flushBatchLocked()
+	}
+	return nil
+}
+
+// flushBatch issues any pending batch verdict. It is called whenever a
+// non-batchable verdict is about to be set, and whenever the read loop
+// returns to nfq_handle_packet.
+func (q *Queue) flushBatch() error {
+	q.batchMu.Lock()
+	defer q.batchMu.Unlock()
+	return q.flushBatchLocked()
+}
+
+func (q *Queue) flushBatchLocked() error {
+	if !q.batchPending {
+		return nil
+	}
+	if C.nfq_set_verdict_batch(q.qh, C.u_int32_t(q.batchMaxID), q.batchVerdict) < 0 {
+		return fmt.Errorf("Error setting batch verdict %d up to packet %d", q.batchVerdict, q.batchMaxID)
+	}
+	q.batchPending = false
+	q.batchCount = 0
+	return nil
 }
 
 // NewQueue creates a Queue instance and registers it.
@@ -175,10 +244,17 @@ func NewQueue(queueID uint16, handler PacketHandler, cfg *QueueConfig) *Queue {
 	return q
 }
 
-// Start the processing of packets from the netfilter queue.
-// This method initializes the netfilter queue and configures it.
-// The thread is blocked until the queue is stopped externally.
-func (q *Queue) Start() error {
+// Run initializes the netfilter queue, configures it, and processes packets
+// from it until ctx is canceled or an unrecoverable error occurs.
+// Cancellation closes the underlying netlink socket, which unblocks
+// nfq_handle_packet inside nfqueue_loop; the close itself is guarded by a
+// sync.Once so a cancellation racing the loop's own exit cannot double-close
+// the fd.
+func (q *Queue) Run(ctx context.Context) error {
+	if err := validateConfig(q.cfg); err != nil {
+		return err
+	}
+
 	// Initialize the netfilter queue
 	if q.h = C.nfq_open(); q.h == nil {
 		return errors.New("Error in nfq_open")
@@ -205,10 +281,7 @@ func (q *Queue) Start() error {
 
 	// Configure the flags (if any)
 	if len(q.cfg.QueueFlags) > 0 {
-		var flags C.uint32_t
-		for _, flag := range q.cfg.QueueFlags {
-			flags &= C.uint32_t(flag)
-		}
+		flags := C.uint32_t(computeQueueFlags(q.cfg.QueueFlags))
 		if ret := C.nfq_set_queue_flags(q.qh, flags, flags); ret < 0 {
 			return errors.New("Error in nfq_set_queue_flags")
 		}
@@ -222,23 +295,86 @@ func (q *Queue) Start() error {
 		C.nfnl_rcvbufsiz(C.nfq_nfnlh(q.h), C.uint(q.cfg.BufferSize))
 	}
 
-	if ret := C.nfqueue_loop(q.h, q.fd); ret < 0 {
-		return errors.New("Error in nfqueue_loop")
+	// Workers and PerCPUAffinity are typically used behind a MultiQueue under
+	// high packet rates, so force (rather than merely request) a larger
+	// socket receive buffer to absorb bursts.
+	if q.cfg.Workers > 0 && q.cfg.BufferSize > 0 {
+		if ret := C.setsockopt(q.fd, C.SOL_SOCKET, C.SO_RCVBUFFORCE,
+			unsafe.Pointer(&q.cfg.BufferSize), C.socklen_t(unsafe.Sizeof(q.cfg.BufferSize))); ret < 0 {
+			return errors.New("Error in setsockopt SO_RCVBUFFORCE")
+		}
 	}
 
-	return nil
-}
+	q.startWorkers()
+	defer q.stopWorkers()
+
+	loopErrCh := make(chan error, 1)
+	go func() {
+		if ret := C.nfqueue_loop(q.h, q.fd); ret < 0 {
+			loopErrCh <- errors.New("Error in nfqueue_loop")
+			return
+		}
+		loopErrCh <- nil
+	}()
 
-// Stop the netfilter queue.
-func (q *Queue) Stop() error {
-	if C.close(q.fd) < 0 {
-		return errors.New("Error closing fd")
+	// Any batch that BatchVerdicts left pending is flushed before shutdown,
+	// while fd and qh are still valid.
+	select {
+	case <-ctx.Done():
+		flushErr := q.flushBatch()
+		if err := q.shutdown(); err != nil {
+			return err
+		}
+		<-loopErrCh
+		return flushErr
+	case err := <-loopErrCh:
+		// nfqueue_loop failed on its own, not via ctx cancellation: the
+		// queue must still be torn down here, since nothing else will
+		// close fd/qh/h on this path.
+		flushErr := q.flushBatch()
+		if shutdownErr := q.shutdown(); shutdownErr != nil {
+			return shutdownErr
+		}
+		if err != nil {
+			return err
+		}
+		return flushErr
 	}
-	if C.nfq_destroy_queue(q.qh) < 0 {
-		return errors.New("Error in nfq_destroy_queue")
+}
+
+// shutdown tears down the netfilter queue. It is idempotent so that it can
+// be called both from a context cancellation and from the natural end of
+// nfqueue_loop without double-closing q.fd.
+func (q *Queue) shutdown() error {
+	var err error
+	q.closeOnce.Do(func() {
+		if C.close(q.fd) < 0 {
+			err = errors.New("Error closing fd")
+			return
+		}
+		if C.nfq_destroy_queue(q.qh) < 0 {
+			err = errors.New("Error in nfq_destroy_queue")
+			return
+		}
+		if C.nfq_close(q.h) < 0 {
+			err = errors.New("Error in nfq_close")
+		}
+	})
+	return err
+}
+
+// SetQueueMaxlenBypass toggles the FailOpen behaviour (NFQA_CFG_F_FAIL_OPEN)
+// at runtime, without requiring the queue to be restarted. This is useful to
+// drain a queue that filled up because consumers are stuck on Stolen packets:
+// enabling bypass lets the kernel accept new packets instead of dropping
+// them while the backlog is cleared.
+func (q *Queue) SetQueueMaxlenBypass(enabled bool) error {
+	var flags C.uint32_t
+	if enabled {
+		flags = C.uint32_t(FailOpen)
 	}
-	if C.nfq_close(q.h) < 0 {
-		return errors.New("Error in nfq_close")
+	if ret := C.nfq_set_queue_flags(q.qh, C.uint32_t(FailOpen), flags); ret < 0 {
+		return errors.New("Error in nfq_set_queue_flags")
 	}
 	return nil
 }
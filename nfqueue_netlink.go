@@ -0,0 +1,661 @@
+/**
+ * @license
+ * Copyright 2018 Telefónica Investigación y Desarrollo, S.A.U
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+//go:build !nfqueue_cgo
+
+// This file implements the Queue backend directly on top of
+// NETLINK_NETFILTER, with no cgo dependency on libnetfilter_queue. It speaks
+// NFNL_SUBSYS_QUEUE itself: building NFQNL_MSG_CONFIG messages to bind the
+// queue and parsing NFQNL_MSG_PACKET messages to build Packet values. Build
+// with -tags nfqueue_cgo to use the cgo binding instead.
+
+package nfqueue
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"runtime"
+	"sync"
+
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	nfnlSubsysQueue = 4
+	nfnetlinkV0     = 0
+
+	nfqnlMsgPacket       = 0
+	nfqnlMsgVerdict      = 1
+	nfqnlMsgConfig       = 2
+	nfqnlMsgVerdictBatch = 3
+
+	nfqnlCfgCmdNone    = 0
+	nfqnlCfgCmdBind    = 1
+	nfqnlCfgCmdUnbind  = 2
+	nfqnlCfgCmdPFBind  = 3
+	nfqnlCfgCmdPFUnbind = 4
+
+	nfqnlCopyPacket = 2
+
+	nfqaCfgCmd        = 1
+	nfqaCfgParams     = 2
+	nfqaCfgQueueMaxlen = 3
+	nfqaCfgMask       = 4
+	nfqaCfgFlags      = 5
+
+	// These mirror enum nfqnl_attr_type from
+	// include/uapi/linux/netfilter/nfnetlink_queue.h.
+	nfqaPacketHdr         = 1
+	nfqaVerdictHdr        = 2
+	nfqaMark              = 3
+	nfqaTimestamp         = 4
+	nfqaIfindexIndev      = 5
+	nfqaIfindexOutdev     = 6
+	nfqaIfindexPhysindev  = 7
+	nfqaIfindexPhysoutdev = 8
+	nfqaHwaddr            = 9
+	nfqaPayload           = 10
+	nfqaCt                = 11
+	nfqaCtInfo            = 12
+	nfqaCapLen            = 13
+	nfqaSkbInfo           = 14
+	nfqaUID               = 16
+	nfqaGID               = 17
+
+	skbInfoGSO = 1 << 1
+
+	// These mirror the NF_* verdicts from linux/netfilter.h. golang.org/x/sys/unix
+	// does not expose them (they are netfilter, not syscall, constants), so the
+	// cgo backend gets them from libnetfilter_queue's headers instead.
+	nfDrop   = 0
+	nfAccept = 1
+	nfStolen = 2
+	nfQueue  = 3
+	nfRepeat = 4
+)
+
+// Queue represents a netfilter queue implemented on top of a raw
+// NETLINK_NETFILTER socket, with a Run method to process packets until its
+// context is canceled.
+type Queue struct {
+	ID      uint16
+	handler PacketHandler
+	cfg     *QueueConfig
+	conn    *netlink.Conn
+
+	batchMu      sync.Mutex
+	batchPending bool
+	batchVerdict uint32
+	batchMaxID   uint32
+	batchCount   int
+
+	packetCh  chan *Packet
+	workersWG sync.WaitGroup
+}
+
+// NewQueue creates a Queue instance and registers it.
+func NewQueue(queueID uint16, handler PacketHandler, cfg *QueueConfig) *Queue {
+	if cfg == nil {
+		cfg = &QueueConfig{}
+	}
+	q := &Queue{
+		ID:      queueID,
+		handler: handler,
+		cfg:     cfg,
+	}
+	queueRegistry.Register(queueID, q)
+	return q
+}
+
+// Run opens a NETLINK_NETFILTER socket, binds the queue ID and delivers
+// packets to the configured handler until ctx is canceled or an
+// unrecoverable error occurs. Cancellation closes the netlink socket, which
+// unblocks the pending Receive; the socket is also closed on every other
+// return path (a bind failure or a Receive error of its own), so a caller
+// that retries Run never leaks a socket or the kernel-side queue
+// registration.
+func (q *Queue) Run(ctx context.Context) error {
+	if err := validateConfig(q.cfg); err != nil {
+		return err
+	}
+
+	conn, err := netlink.Dial(unix.NETLINK_NETFILTER, nil)
+	if err != nil {
+		return fmt.Errorf("Error dialing NETLINK_NETFILTER: %v", err)
+	}
+	q.conn = conn
+	defer q.conn.Close()
+
+	if err := q.bind(); err != nil {
+		return err
+	}
+
+	q.startWorkers()
+	defer q.stopWorkers()
+
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+			q.conn.Close()
+		case <-stopped:
+		}
+	}()
+
+	for {
+		msgs, err := conn.Receive()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				// The loop only unwinds here once Receive has no more
+				// buffered data to deliver, so this is the natural point to
+				// flush any batch that BatchVerdicts left pending.
+				return q.flushBatch()
+			default:
+				return fmt.Errorf("Error receiving from netlink: %v", err)
+			}
+		}
+		for _, msg := range msgs {
+			q.handleMessage(msg)
+		}
+		if err := q.flushBatch(); err != nil {
+			return err
+		}
+	}
+}
+
+// bind sends the NFQNL_MSG_CONFIG messages needed to attach to the queue:
+// PF_BIND, BIND, SET_MODE (packet copy) and, if configured, the queue
+// maxlen and flags.
+func (q *Queue) bind() error {
+	if err := q.sendConfigCmd(nfqnlCfgCmdPFBind, unix.AF_INET); err != nil {
+		return err
+	}
+	if err := q.sendConfigCmd(nfqnlCfgCmdBind, 0); err != nil {
+		return err
+	}
+	if err := q.sendConfigParams(); err != nil {
+		return err
+	}
+	if q.cfg.MaxPackets > 0 {
+		if err := q.sendConfigAttr(nfqaCfgQueueMaxlen, q.cfg.MaxPackets); err != nil {
+			return err
+		}
+	}
+	if len(q.cfg.QueueFlags) > 0 {
+		flags := computeQueueFlags(q.cfg.QueueFlags)
+		ae := netlink.NewAttributeEncoder()
+		ae.ByteOrder = binary.BigEndian
+		ae.Uint32(nfqaCfgFlags, flags)
+		ae.Uint32(nfqaCfgMask, flags)
+		return q.sendConfig(ae)
+	}
+	return nil
+}
+
+func (q *Queue) sendConfigCmd(cmd uint8, pf uint16) error {
+	ae := netlink.NewAttributeEncoder()
+	ae.ByteOrder = binary.BigEndian
+	ae.Do(nfqaCfgCmd, func() ([]byte, error) {
+		b := make([]byte, 4)
+		b[0] = cmd
+		binary.BigEndian.PutUint16(b[2:], pf)
+		return b, nil
+	})
+	return q.sendConfig(ae)
+}
+
+func (q *Queue) sendConfigParams() error {
+	ae := netlink.NewAttributeEncoder()
+	ae.ByteOrder = binary.BigEndian
+	ae.Do(nfqaCfgParams, func() ([]byte, error) {
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint32(b, nfqnlCopyPacket)
+		return b, nil
+	})
+	return q.sendConfig(ae)
+}
+
+func (q *Queue) sendConfigAttr(attr uint16, v uint32) error {
+	ae := netlink.NewAttributeEncoder()
+	ae.ByteOrder = binary.BigEndian
+	ae.Uint32(attr, v)
+	return q.sendConfig(ae)
+}
+
+func (q *Queue) sendConfig(ae *netlink.AttributeEncoder) error {
+	attrs, err := ae.Encode()
+	if err != nil {
+		return fmt.Errorf("Error encoding NFQNL_MSG_CONFIG attributes: %v", err)
+	}
+	msg := netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType((nfnlSubsysQueue << 8) | nfqnlMsgConfig),
+			Flags: netlink.Request | netlink.Acknowledge,
+		},
+		Data: append(nfgenmsgHeader(q.ID), attrs...),
+	}
+	if _, err := q.conn.Execute(msg); err != nil {
+		return fmt.Errorf("Error sending NFQNL_MSG_CONFIG: %v", err)
+	}
+	return nil
+}
+
+// nfgenmsgHeader builds the struct nfgenmsg header (family, version, res_id)
+// that prefixes every nfnetlink message, with res_id set to the queue ID in
+// network byte order as required by the protocol.
+func nfgenmsgHeader(queueID uint16) []byte {
+	b := make([]byte, 4)
+	b[0] = unix.AF_UNSPEC
+	b[1] = nfnetlinkV0
+	binary.BigEndian.PutUint16(b[2:], queueID)
+	return b
+}
+
+// handleMessage parses a single NFQNL_MSG_PACKET message and dispatches the
+// resulting Packet to the configured handler.
+func (q *Queue) handleMessage(msg netlink.Message) {
+	msgType := uint8(msg.Header.Type) & 0xff
+	if msgType != nfqnlMsgPacket {
+		return
+	}
+	if len(msg.Data) < 4 {
+		return
+	}
+	ad, err := netlink.NewAttributeDecoder(msg.Data[4:])
+	if err != nil {
+		return
+	}
+	ad.ByteOrder = binary.BigEndian
+
+	var id uint32
+	var payload []byte
+	meta := &PacketMeta{}
+
+	for ad.Next() {
+		switch ad.Type() {
+		case nfqaPacketHdr:
+			hdr := ad.Bytes()
+			if len(hdr) >= 4 {
+				id = binary.BigEndian.Uint32(hdr)
+			}
+		case nfqaPayload:
+			payload = append([]byte(nil), ad.Bytes()...)
+		case nfqaMark:
+			meta.NFMark = ad.Uint32()
+		case nfqaIfindexIndev:
+			meta.InDev = ad.Uint32()
+		case nfqaIfindexOutdev:
+			meta.OutDev = ad.Uint32()
+		case nfqaIfindexPhysindev:
+			meta.PhysInDev = ad.Uint32()
+		case nfqaIfindexPhysoutdev:
+			meta.PhysOutDev = ad.Uint32()
+		case nfqaHwaddr:
+			hw := ad.Bytes()
+			if len(hw) >= 8 {
+				meta.HWAddr = append([]byte(nil), hw[4:10]...)
+			}
+		case nfqaUID:
+			meta.UID = ad.Uint32()
+			meta.HasUID = true
+		case nfqaGID:
+			meta.GID = ad.Uint32()
+			meta.HasGID = true
+		case nfqaCapLen:
+			meta.CapLen = ad.Uint32()
+		case nfqaSkbInfo:
+			meta.GSO = ad.Uint32()&skbInfoGSO != 0
+		case nfqaCt:
+			meta.Conntrack = parseConntrack(ad.Bytes())
+		}
+	}
+	if ad.Err() != nil {
+		return
+	}
+
+	q.dispatch(id, payload, meta)
+}
+
+// parseConntrack decodes the nested CTA_* attributes carried in NFQA_CT.
+// Only the fields surfaced on ConntrackInfo are parsed.
+func parseConntrack(b []byte) *ConntrackInfo {
+	ad, err := netlink.NewAttributeDecoder(b)
+	if err != nil {
+		return nil
+	}
+	ad.ByteOrder = binary.BigEndian
+	info := &ConntrackInfo{}
+	// These mirror enum ctattr_type from
+	// include/uapi/linux/netfilter/nfnetlink_conntrack.h.
+	const (
+		ctaTupleOrig  = 1
+		ctaTupleReply = 2
+		ctaStatus     = 3
+		ctaMark       = 8
+		ctaZone       = 18
+	)
+	for ad.Next() {
+		switch ad.Type() {
+		case ctaTupleOrig:
+			info.Orig = parseConntrackTuple(ad.Bytes())
+		case ctaTupleReply:
+			info.Reply = parseConntrackTuple(ad.Bytes())
+		case ctaStatus:
+			status := ad.Uint32()
+			// Bit numbers from enum ip_conntrack_status in
+			// nf_conntrack_common.h.
+			const (
+				ipsExpected  = 1 << 0
+				ipsSeenReply = 1 << 1
+				ipsSrcNat    = 1 << 4
+				ipsDstNat    = 1 << 5
+			)
+			switch {
+			case status&ipsExpected != 0:
+				// Created from an expectation (e.g. an ICMP error or an FTP
+				// data connection), rather than seen directly by the
+				// ruleset.
+				info.State = ConntrackStateRelated
+			case status&ipsSeenReply == 0:
+				info.State = ConntrackStateNew
+			default:
+				info.State = ConntrackStateEstablished
+			}
+			info.SNAT = status&ipsSrcNat != 0
+			info.DNAT = status&ipsDstNat != 0
+		case ctaMark:
+			info.Mark = ad.Uint32()
+		case ctaZone:
+			info.Zone = ad.Uint16()
+		}
+	}
+	return info
+}
+
+func parseConntrackTuple(b []byte) ConntrackTuple {
+	ad, err := netlink.NewAttributeDecoder(b)
+	if err != nil {
+		return ConntrackTuple{}
+	}
+	ad.ByteOrder = binary.BigEndian
+	var t ConntrackTuple
+	const (
+		ctaTupleIP    = 1
+		ctaTupleProto = 2
+		ctaIPv4Src    = 1
+		ctaIPv4Dst    = 2
+		ctaProtoNum   = 1
+		ctaProtoSrcPort = 2
+		ctaProtoDstPort = 3
+	)
+	for ad.Next() {
+		switch ad.Type() {
+		case ctaTupleIP:
+			inner, err := netlink.NewAttributeDecoder(ad.Bytes())
+			if err != nil {
+				continue
+			}
+			for inner.Next() {
+				switch inner.Type() {
+				case ctaIPv4Src:
+					t.SrcIP = net.IP(inner.Bytes())
+				case ctaIPv4Dst:
+					t.DstIP = net.IP(inner.Bytes())
+				}
+			}
+		case ctaTupleProto:
+			inner, err := netlink.NewAttributeDecoder(ad.Bytes())
+			if err != nil {
+				continue
+			}
+			inner.ByteOrder = binary.BigEndian
+			for inner.Next() {
+				switch inner.Type() {
+				case ctaProtoNum:
+					t.L4Proto = inner.Uint8()
+				case ctaProtoSrcPort:
+					t.SrcPort = inner.Uint16()
+				case ctaProtoDstPort:
+					t.DstPort = inner.Uint16()
+				}
+			}
+		}
+	}
+	return t
+}
+
+// dispatch hands a parsed packet off to the worker pool (if configured) or
+// invokes the handler inline on the netlink read goroutine.
+func (q *Queue) dispatch(id uint32, buffer []byte, meta *PacketMeta) {
+	p := &Packet{Buffer: buffer, Meta: meta, id: id, q: q}
+	if q.cfg.Workers > 0 {
+		q.packetCh <- p
+		return
+	}
+	q.handler.Handle(p)
+}
+
+func (q *Queue) startWorkers() {
+	if q.cfg.Workers <= 0 {
+		return
+	}
+	q.packetCh = make(chan *Packet, q.cfg.Workers*64)
+	for i := 0; i < q.cfg.Workers; i++ {
+		worker := i
+		q.workersWG.Add(1)
+		go func() {
+			defer q.workersWG.Done()
+			if q.cfg.PerCPUAffinity {
+				if err := pinToCPU(worker); err != nil {
+					return
+				}
+			}
+			for p := range q.packetCh {
+				q.handler.Handle(p)
+			}
+		}()
+	}
+}
+
+// pinToCPU locks the calling goroutine to its current OS thread and pins
+// that thread to cpu via sched_setaffinity(2).
+func pinToCPU(cpu int) error {
+	runtime.LockOSThread()
+	var set unix.CPUSet
+	set.Zero()
+	set.Set(cpu)
+	if err := unix.SchedSetaffinity(0, &set); err != nil {
+		return fmt.Errorf("Error pinning worker to CPU %d: %v", cpu, err)
+	}
+	return nil
+}
+
+func (q *Queue) stopWorkers() {
+	if q.cfg.Workers <= 0 {
+		return
+	}
+	close(q.packetCh)
+	q.workersWG.Wait()
+}
+
+// queueBatchVerdict buffers a verdict for later flushing instead of issuing
+// it immediately. A packet whose verdict differs from the one already
+// pending forces a flush of the existing batch first, since
+// NFQNL_MSG_VERDICT_BATCH applies a single verdict to every ID up to and
+// including the one given.
+func (q *Queue) queueBatchVerdict(id uint32, verdict uint32) error {
+	q.batchMu.Lock()
+	defer q.batchMu.Unlock()
+
+	if q.batchPending && q.batchVerdict != verdict {
+		if err := q.flushBatchLocked(); err != nil {
+			return err
+		}
+	}
+
+	q.batchPending = true
+	q.batchVerdict = verdict
+	q.batchMaxID = id
+	q.batchCount++
+
+	if q.cfg.BatchWindow > 0 && q.batchCount >= q.cfg.BatchWindow {
+		return q.flushBatchLocked()
+	}
+	return nil
+}
+
+// flushBatch issues any pending batch verdict. It is called whenever a
+// non-batchable verdict is about to be set, and after Run has handled every
+// message returned by one Receive.
+func (q *Queue) flushBatch() error {
+	q.batchMu.Lock()
+	defer q.batchMu.Unlock()
+	return q.flushBatchLocked()
+}
+
+func (q *Queue) flushBatchLocked() error {
+	if !q.batchPending {
+		return nil
+	}
+	ae := netlink.NewAttributeEncoder()
+	ae.ByteOrder = binary.BigEndian
+	ae.Do(nfqaVerdictHdr, func() ([]byte, error) {
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint32(b, q.batchVerdict)
+		binary.BigEndian.PutUint32(b[4:], q.batchMaxID)
+		return b, nil
+	})
+	attrs, err := ae.Encode()
+	if err != nil {
+		return fmt.Errorf("Error encoding batch verdict up to packet %d: %v", q.batchMaxID, err)
+	}
+	msg := netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType((nfnlSubsysQueue << 8) | nfqnlMsgVerdictBatch),
+			Flags: netlink.Request,
+		},
+		Data: append(nfgenmsgHeader(q.ID), attrs...),
+	}
+	if _, err := q.conn.Send(msg); err != nil {
+		return fmt.Errorf("Error setting batch verdict %d up to packet %d: %v", q.batchVerdict, q.batchMaxID, err)
+	}
+	q.batchPending = false
+	q.batchCount = 0
+	return nil
+}
+
+func (p *Packet) setVerdict(verdict uint32, mark *uint32, buffer []byte) error {
+	if p.q.cfg.BatchVerdicts && mark == nil && buffer == nil {
+		return p.q.queueBatchVerdict(p.id, verdict)
+	}
+	if err := p.q.flushBatch(); err != nil {
+		return err
+	}
+	ae := netlink.NewAttributeEncoder()
+	ae.ByteOrder = binary.BigEndian
+	ae.Do(nfqaVerdictHdr, func() ([]byte, error) {
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint32(b, verdict)
+		binary.BigEndian.PutUint32(b[4:], p.id)
+		return b, nil
+	})
+	if mark != nil {
+		ae.Uint32(nfqaMark, *mark)
+	}
+	if buffer != nil {
+		ae.Bytes(nfqaPayload, buffer)
+	}
+	attrs, err := ae.Encode()
+	if err != nil {
+		return fmt.Errorf("Error encoding verdict for packet %d: %v", p.id, err)
+	}
+	msg := netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType((nfnlSubsysQueue << 8) | nfqnlMsgVerdict),
+			Flags: netlink.Request,
+		},
+		Data: append(nfgenmsgHeader(p.q.ID), attrs...),
+	}
+	if _, err := p.q.conn.Send(msg); err != nil {
+		return fmt.Errorf("Error setting verdict %d for packet %d: %v", verdict, p.id, err)
+	}
+	return nil
+}
+
+// Accept the packet.
+func (p *Packet) Accept() error {
+	return p.setVerdict(nfAccept, nil, nil)
+}
+
+// Drop the packet.
+func (p *Packet) Drop() error {
+	return p.setVerdict(nfDrop, nil, nil)
+}
+
+// Repeat makes the packet re-traverse the ruleset from the start (NF_REPEAT).
+func (p *Packet) Repeat() error {
+	return p.setVerdict(nfRepeat, nil, nil)
+}
+
+// Stolen tells the kernel that userspace has taken ownership of the packet (NF_STOLEN).
+func (p *Packet) Stolen() error {
+	return p.setVerdict(nfStolen, nil, nil)
+}
+
+// Requeue hands the packet off to another nfqueue queue.
+func (p *Packet) Requeue(queueID uint16) error {
+	verdict := uint32(nfQueue) | (uint32(queueID) << 16)
+	return p.setVerdict(verdict, nil, nil)
+}
+
+// Modify the packet with a new buffer.
+func (p *Packet) Modify(buffer []byte) error {
+	return p.setVerdict(nfAccept, nil, buffer)
+}
+
+// AcceptWithMark accepts the packet and sets its NFMark to mark.
+func (p *Packet) AcceptWithMark(mark uint32) error {
+	return p.setVerdict(nfAccept, &mark, nil)
+}
+
+// RepeatWithMark re-queues the packet to the head of the same ruleset and sets its NFMark to mark.
+func (p *Packet) RepeatWithMark(mark uint32) error {
+	return p.setVerdict(nfRepeat, &mark, nil)
+}
+
+// ModifyWithMark modifies the packet with a new buffer and sets its NFMark to mark.
+func (p *Packet) ModifyWithMark(buffer []byte, mark uint32) error {
+	return p.setVerdict(nfAccept, &mark, buffer)
+}
+
+// SetQueueMaxlenBypass toggles the FailOpen behaviour (NFQA_CFG_F_FAIL_OPEN) at runtime.
+func (q *Queue) SetQueueMaxlenBypass(enabled bool) error {
+	var flags uint32
+	if enabled {
+		flags = uint32(FailOpen)
+	}
+	ae := netlink.NewAttributeEncoder()
+	ae.ByteOrder = binary.BigEndian
+	ae.Uint32(nfqaCfgFlags, flags)
+	ae.Uint32(nfqaCfgMask, uint32(FailOpen))
+	return q.sendConfig(ae)
+}
@@ -0,0 +1,267 @@
+/**
+ * @license
+ * Copyright 2018 Telefónica Investigación y Desarrollo, S.A.U
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+//go:build !nfqueue_cgo
+
+package nfqueue
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nltest"
+)
+
+// buildConntrackAttrs hand-assembles an NFQA_CT payload carrying the nested
+// CTA_TUPLE_ORIG/CTA_TUPLE_REPLY, CTA_STATUS, CTA_MARK and CTA_ZONE
+// attributes the kernel would attach to a packet belonging to a NATed,
+// established connection.
+func buildConntrackAttrs(t *testing.T) []byte {
+	t.Helper()
+
+	const (
+		ctaTupleIP      = 1
+		ctaTupleProto   = 2
+		ctaIPv4Src      = 1
+		ctaIPv4Dst      = 2
+		ctaProtoNum     = 1
+		ctaProtoSrcPort = 2
+		ctaProtoDstPort = 3
+	)
+
+	tuple := func(src, dst net.IP, proto uint8, srcPort, dstPort uint16) []byte {
+		ae := netlink.NewAttributeEncoder()
+		ae.ByteOrder = binary.BigEndian
+		ae.Nested(ctaTupleIP, func(nae *netlink.AttributeEncoder) error {
+			nae.Bytes(ctaIPv4Src, src.To4())
+			nae.Bytes(ctaIPv4Dst, dst.To4())
+			return nil
+		})
+		ae.Nested(ctaTupleProto, func(nae *netlink.AttributeEncoder) error {
+			nae.ByteOrder = binary.BigEndian
+			nae.Uint8(ctaProtoNum, proto)
+			nae.Uint16(ctaProtoSrcPort, srcPort)
+			nae.Uint16(ctaProtoDstPort, dstPort)
+			return nil
+		})
+		b, err := ae.Encode()
+		if err != nil {
+			t.Fatalf("encoding tuple: %v", err)
+		}
+		return b
+	}
+
+	orig := tuple(net.IPv4(192, 168, 1, 10), net.IPv4(93, 184, 216, 34), 6, 53172, 443)
+	reply := tuple(net.IPv4(93, 184, 216, 34), net.IPv4(203, 0, 113, 1), 6, 443, 53172)
+
+	const (
+		ctaTupleOrig  = 1
+		ctaTupleReply = 2
+		ctaStatus     = 3
+		ctaMark       = 8
+		ctaZone       = 18
+
+		ipsConfirmed = 1 << 3
+		ipsSeenReply = 1 << 1
+		ipsSrcNat    = 1 << 4
+		ipsDstNat    = 1 << 5
+	)
+
+	ae := netlink.NewAttributeEncoder()
+	ae.ByteOrder = binary.BigEndian
+	ae.Bytes(ctaTupleOrig, orig)
+	ae.Bytes(ctaTupleReply, reply)
+	ae.Uint32(ctaStatus, ipsConfirmed|ipsSeenReply|ipsSrcNat)
+	ae.Uint32(ctaMark, 0x2a)
+	ae.Uint16(ctaZone, 7)
+
+	b, err := ae.Encode()
+	if err != nil {
+		t.Fatalf("encoding NFQA_CT: %v", err)
+	}
+	return b
+}
+
+func TestParseConntrack(t *testing.T) {
+	info := parseConntrack(buildConntrackAttrs(t))
+
+	if info == nil {
+		t.Fatal("parseConntrack returned nil")
+	}
+	if info.State != ConntrackStateEstablished {
+		t.Errorf("State = %v, want ConntrackStateEstablished", info.State)
+	}
+	if !info.SNAT {
+		t.Error("SNAT = false, want true (IPS_SRC_NAT_BIT set)")
+	}
+	if info.DNAT {
+		t.Error("DNAT = true, want false (IPS_DST_NAT_BIT not set)")
+	}
+	if info.Mark != 0x2a {
+		t.Errorf("Mark = %#x, want 0x2a", info.Mark)
+	}
+	if info.Zone != 7 {
+		t.Errorf("Zone = %d, want 7", info.Zone)
+	}
+	if got, want := info.Orig.SrcIP.String(), "192.168.1.10"; got != want {
+		t.Errorf("Orig.SrcIP = %s, want %s", got, want)
+	}
+	if got, want := info.Orig.DstIP.String(), "93.184.216.34"; got != want {
+		t.Errorf("Orig.DstIP = %s, want %s", got, want)
+	}
+	if info.Orig.L4Proto != 6 {
+		t.Errorf("Orig.L4Proto = %d, want 6", info.Orig.L4Proto)
+	}
+	if info.Orig.SrcPort != 53172 || info.Orig.DstPort != 443 {
+		t.Errorf("Orig ports = %d/%d, want 53172/443", info.Orig.SrcPort, info.Orig.DstPort)
+	}
+	if got, want := info.Reply.SrcIP.String(), "93.184.216.34"; got != want {
+		t.Errorf("Reply.SrcIP = %s, want %s", got, want)
+	}
+}
+
+func TestParseConntrackState(t *testing.T) {
+	const (
+		ctaStatus = 3
+
+		ipsExpected  = 1 << 0
+		ipsSeenReply = 1 << 1
+		ipsConfirmed = 1 << 3
+	)
+
+	buildStatus := func(t *testing.T, status uint32) []byte {
+		t.Helper()
+		ae := netlink.NewAttributeEncoder()
+		ae.ByteOrder = binary.BigEndian
+		ae.Uint32(ctaStatus, status)
+		b, err := ae.Encode()
+		if err != nil {
+			t.Fatalf("encoding NFQA_CT: %v", err)
+		}
+		return b
+	}
+
+	cases := []struct {
+		name   string
+		status uint32
+		want   ConntrackState
+	}{
+		{"no reply seen yet", ipsConfirmed, ConntrackStateNew},
+		{"reply seen", ipsConfirmed | ipsSeenReply, ConntrackStateEstablished},
+		{"created from an expectation", ipsExpected, ConntrackStateRelated},
+		{"expectation bit wins over seen-reply", ipsExpected | ipsSeenReply, ConntrackStateRelated},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			info := parseConntrack(buildStatus(t, tc.status))
+			if info.State != tc.want {
+				t.Errorf("State = %v, want %v", info.State, tc.want)
+			}
+		})
+	}
+}
+
+// decodeBatchVerdict extracts the verdict and max packet ID carried by an
+// NFQNL_MSG_VERDICT_BATCH message's NFQA_VERDICT_HDR attribute.
+func decodeBatchVerdict(t *testing.T, msg netlink.Message) (verdict, maxID uint32) {
+	t.Helper()
+	if got, want := msg.Header.Type, netlink.HeaderType((nfnlSubsysQueue<<8)|nfqnlMsgVerdictBatch); got != want {
+		t.Fatalf("message type = %v, want %v", got, want)
+	}
+	ad, err := netlink.NewAttributeDecoder(msg.Data[4:])
+	if err != nil {
+		t.Fatalf("decoding verdict batch attrs: %v", err)
+	}
+	ad.ByteOrder = binary.BigEndian
+	for ad.Next() {
+		if ad.Type() == nfqaVerdictHdr {
+			hdr := ad.Bytes()
+			verdict = binary.BigEndian.Uint32(hdr)
+			maxID = binary.BigEndian.Uint32(hdr[4:])
+		}
+	}
+	return verdict, maxID
+}
+
+// TestQueueBatchVerdict drives the batch state machine through a fake
+// netlink.Conn (via nltest.Dial) and inspects the NFQNL_MSG_VERDICT_BATCH
+// messages it actually sends, rather than just the in-memory batch fields.
+func TestQueueBatchVerdict(t *testing.T) {
+	var sent []netlink.Message
+	conn := nltest.Dial(func(req []netlink.Message) ([]netlink.Message, error) {
+		sent = append(sent, req...)
+		return nil, nil
+	})
+	defer conn.Close()
+
+	q := &Queue{cfg: &QueueConfig{BatchVerdicts: true, BatchWindow: 3}, conn: conn}
+
+	// Same-verdict packets accumulate without flushing.
+	if err := q.queueBatchVerdict(1, nfAccept); err != nil {
+		t.Fatalf("queueBatchVerdict(1): %v", err)
+	}
+	if err := q.queueBatchVerdict(2, nfAccept); err != nil {
+		t.Fatalf("queueBatchVerdict(2): %v", err)
+	}
+	if len(sent) != 0 {
+		t.Fatalf("got %d messages sent while accumulating, want 0", len(sent))
+	}
+	if !q.batchPending || q.batchVerdict != nfAccept || q.batchMaxID != 2 || q.batchCount != 2 {
+		t.Fatalf("batch state = %+v, want pending accept up to id 2, count 2", q)
+	}
+
+	// A differing verdict forces the pending batch to flush first.
+	if err := q.queueBatchVerdict(3, nfDrop); err != nil {
+		t.Fatalf("queueBatchVerdict(3): %v", err)
+	}
+	if len(sent) != 1 {
+		t.Fatalf("got %d messages sent after differing verdict, want 1", len(sent))
+	}
+	if verdict, maxID := decodeBatchVerdict(t, sent[0]); verdict != nfAccept || maxID != 2 {
+		t.Errorf("flushed batch = (verdict %d, maxID %d), want (accept, 2)", verdict, maxID)
+	}
+	if !q.batchPending || q.batchVerdict != nfDrop || q.batchMaxID != 3 || q.batchCount != 1 {
+		t.Fatalf("batch state after flush = %+v, want pending drop up to id 3, count 1", q)
+	}
+
+	// Reaching BatchWindow flushes automatically.
+	if err := q.queueBatchVerdict(4, nfDrop); err != nil {
+		t.Fatalf("queueBatchVerdict(4): %v", err)
+	}
+	if err := q.queueBatchVerdict(5, nfDrop); err != nil {
+		t.Fatalf("queueBatchVerdict(5): %v", err)
+	}
+	if len(sent) != 2 {
+		t.Fatalf("got %d messages sent after reaching BatchWindow, want 2", len(sent))
+	}
+	if verdict, maxID := decodeBatchVerdict(t, sent[1]); verdict != nfDrop || maxID != 5 {
+		t.Errorf("flushed batch = (verdict %d, maxID %d), want (drop, 5)", verdict, maxID)
+	}
+	if q.batchPending {
+		t.Error("batch should not be pending once BatchWindow flushed it")
+	}
+
+	// flushBatch on an empty batch is a no-op.
+	if err := q.flushBatch(); err != nil {
+		t.Fatalf("flushBatch on empty batch: %v", err)
+	}
+	if len(sent) != 2 {
+		t.Fatalf("got %d messages sent after flushing an empty batch, want 2", len(sent))
+	}
+}
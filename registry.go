@@ -0,0 +1,49 @@
+/**
+ * @license
+ * Copyright 2018 Telefónica Investigación y Desarrollo, S.A.U
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nfqueue
+
+import "sync"
+
+// queueRegistry maps a queue ID back to its Queue. The cgo backend's C
+// callback cannot carry a Go pointer as its userdata (see the comment on
+// Run), so it passes the queue ID across the cgo boundary instead and looks
+// the Queue back up here.
+var queueRegistry registry
+
+type registry struct {
+	mu     sync.Mutex
+	queues map[uint16]*Queue
+}
+
+// Register records q under queueID, replacing any queue previously
+// registered under the same ID.
+func (r *registry) Register(queueID uint16, q *Queue) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.queues == nil {
+		r.queues = make(map[uint16]*Queue)
+	}
+	r.queues[queueID] = q
+}
+
+// Lookup returns the Queue registered under queueID, or nil if none was.
+func (r *registry) Lookup(queueID uint16) *Queue {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.queues[queueID]
+}
@@ -0,0 +1,246 @@
+/**
+ * @license
+ * Copyright 2018 Telefónica Investigación y Desarrollo, S.A.U
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// This file holds the types shared by every Queue backend (the cgo
+// libnetfilter_queue binding and the pure-Go netlink implementation), so
+// that callers can switch backends via the nfqueue_cgo build tag without
+// changing any other code.
+
+package nfqueue
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/eclipsesatcom/nfqueue/decode"
+)
+
+// PacketHandler is an interface to handle a packet retrieved by netfilter.
+type PacketHandler interface {
+	Handle(p *Packet)
+}
+
+// PacketMeta contains metadata about a packet
+type PacketMeta struct {
+	HasUID     bool
+	HasGID     bool
+	UID        uint32
+	GID        uint32
+	InDev      uint32
+	OutDev     uint32
+	PhysInDev  uint32
+	PhysOutDev uint32
+	NFMark     uint32
+	HWAddr     []byte
+	// CapLen is the original packet length as reported by NFQA_CAP_LEN, which
+	// may be larger than len(Packet.Buffer) when the packet was truncated.
+	CapLen uint32
+	// GSO reports whether NFQA_SKB_INFO carried NFQA_SKB_GSO, i.e. the kernel
+	// handed us a segmented (not yet normalized) packet. Only populated when
+	// the GSO queue flag is set.
+	GSO bool
+	// Conntrack holds the connection tracking information carried in
+	// NFQA_CT. It is only populated when the Conntrack queue flag is set and
+	// the kernel attached a conntrack entry to the packet.
+	Conntrack *ConntrackInfo
+}
+
+// ConntrackState is the connection tracking state of a packet, as reported
+// by the CTA_STATUS bits of NFQA_CT.
+type ConntrackState int
+
+const (
+	// ConntrackStateNew means the connection has not yet seen a reply (IPS_SEEN_REPLY unset).
+	ConntrackStateNew ConntrackState = iota
+	// ConntrackStateEstablished means the packet belongs to a known, two-way connection.
+	ConntrackStateEstablished
+	// ConntrackStateRelated means the packet is related to an existing connection
+	// (e.g. an ICMP error or an FTP data connection).
+	ConntrackStateRelated
+)
+
+// ConntrackTuple identifies one direction of a tracked flow.
+type ConntrackTuple struct {
+	SrcIP   net.IP
+	DstIP   net.IP
+	SrcPort uint16
+	DstPort uint16
+	L4Proto uint8
+}
+
+// ConntrackInfo is the connection tracking metadata attached to a packet via
+// NFQA_CT, parsed from the nested CTA_TUPLE_ORIG, CTA_TUPLE_REPLY,
+// CTA_STATUS, CTA_MARK and CTA_ZONE attributes.
+type ConntrackInfo struct {
+	// Orig is the tuple in the original direction the connection was first seen.
+	Orig ConntrackTuple
+	// Reply is the tuple in the reply direction, which differs from Orig when
+	// the connection has been NATed.
+	Reply ConntrackTuple
+	State ConntrackState
+	Mark  uint32
+	Zone  uint16
+	// SNAT reports whether the connection is subject to source NAT, derived
+	// from the CTA_STATUS NAT bits.
+	SNAT bool
+	// DNAT reports whether the connection is subject to destination NAT.
+	DNAT bool
+}
+
+// InDevName returns the name of the input interface
+func (m *PacketMeta) InDevName() string {
+	iface, err := net.InterfaceByIndex(int(m.InDev))
+	if err != nil {
+		return ""
+	}
+	return iface.Name
+}
+
+// OutDevName returns the name of the output interface
+func (m *PacketMeta) OutDevName() string {
+	iface, err := net.InterfaceByIndex(int(m.OutDev))
+	if err != nil {
+		return ""
+	}
+	return iface.Name
+}
+
+// PhysInDevName returns the name of the physical input interface
+func (m *PacketMeta) PhysInDevName() string {
+	iface, err := net.InterfaceByIndex(int(m.PhysInDev))
+	if err != nil {
+		return ""
+	}
+	return iface.Name
+}
+
+// PhysOutDevName returns the name of the physical output interface
+func (m *PacketMeta) PhysOutDevName() string {
+	iface, err := net.InterfaceByIndex(int(m.PhysOutDev))
+	if err != nil {
+		return ""
+	}
+	return iface.Name
+}
+
+// MACAddr returns the human-readable value of the MAC address for the packet source
+func (m *PacketMeta) MACAddr() string {
+	return fmt.Sprintf(
+		"%02X:%02X:%02X:%02X:%02X:%02X",
+		m.HWAddr[0], m.HWAddr[1], m.HWAddr[2], m.HWAddr[3], m.HWAddr[4], m.HWAddr[5],
+	)
+}
+
+// Packet struct provides the packet data and methods to accept, drop or modify the packet.
+// The verdict methods themselves (Accept, Drop, Modify, ...) are implemented
+// per-backend, since they talk to the kernel in backend-specific ways.
+type Packet struct {
+	Buffer []byte
+	Meta   *PacketMeta
+	id     uint32
+	q      *Queue
+
+	// decoded caches the result of Decode, so that SrcIP, DstIP, L4 and
+	// Rewrite only parse Buffer once per packet.
+	decoded *decode.Packet
+}
+
+// IsGSO reports whether this packet was delivered unnormalized (segmented)
+// because the GSO queue flag is enabled. Batch verdicts should be avoided for
+// such packets, since they are more likely to need an individual decision.
+func (p *Packet) IsGSO() bool {
+	return p.Meta != nil && p.Meta.GSO
+}
+
+// QueueFlag configures the kernel queue.
+type QueueFlag uint32
+
+const (
+	// FailOpen (requires Linux kernel >= 3.6): the kernel will accept the packets if the kernel queue gets full.
+	// If this flag is not set, the default action in this case is to drop packets.
+	FailOpen QueueFlag = (1 << 0)
+	// Conntrack (requires Linux kernel >= 3.6): the kernel will include the Connection Tracking system information.
+	Conntrack QueueFlag = (1 << 1)
+	// GSO (requires Linux kernel >= 3.10): the kernel will not normalize offload packets,
+	// i.e. your application will need to be able to handle packets larger than the mtu.
+	GSO QueueFlag = (1 << 2)
+	// UIDGid makes the kernel dump UID and GID of the socket to which each packet belongs.
+	UIDGid QueueFlag = (1 << 3)
+	// Secctx makes the kernel dump security context of the socket to which each packet belongs.
+	Secctx QueueFlag = (1 << 4)
+)
+
+// QueueConfig contains optional configuration parameters to initialize a queue.
+type QueueConfig struct {
+	MaxPackets uint32
+	QueueFlags []QueueFlag
+	BufferSize uint32
+	// BatchVerdicts coalesces consecutive Accept/Drop verdicts (no mark, no
+	// payload rewrite) into a single NFQNL_MSG_VERDICT_BATCH message, which
+	// amortizes netlink syscalls under high packet rates. Verdicts that
+	// differ from the pending batch, or that carry a mark or a modified
+	// buffer, flush the batch out-of-band first. Cannot be combined with
+	// Workers, since a batch verdict applies to every packet ID up to the one
+	// given, including packets still in flight to a different worker.
+	BatchVerdicts bool
+	// BatchWindow is the maximum number of packets to accumulate before the
+	// batch is flushed, in addition to the implicit flush whenever the read
+	// loop returns to nfq_handle_packet. Zero means no limit other than the
+	// implicit per-loop flush.
+	BatchWindow int
+	// Workers is the number of goroutines used to drain packets and invoke
+	// PacketHandler.Handle. When zero, packets are handled inline on the
+	// netlink read thread, as before. When positive, the netlink callback
+	// only enqueues the packet and returns immediately, so a slow handler
+	// cannot stall delivery of subsequent packets. Workers cannot be combined
+	// with BatchVerdicts; Run returns an error if both are set.
+	Workers int
+	// PerCPUAffinity pins each worker goroutine to the CPU matching its
+	// index via sched_setaffinity. Combined with MultiQueue and iptables'
+	// --queue-balance, this gives per-CPU packet steering.
+	PerCPUAffinity bool
+}
+
+// errWorkersWithBatchVerdicts is returned by Run when a QueueConfig combines
+// Workers with BatchVerdicts. A batch verdict applies to every packet ID up
+// to and including the one given, so a fast worker flushing a batch for a
+// high ID would silently pre-verdict a lower ID that a slower worker hasn't
+// decided on yet. Until batch flushes are serialized with worker dispatch
+// order, the combination is rejected outright rather than left to corrupt
+// verdicts under load.
+var errWorkersWithBatchVerdicts = errors.New("nfqueue: Workers and BatchVerdicts cannot be combined")
+
+// validateConfig rejects QueueConfig combinations that neither backend can
+// support safely.
+func validateConfig(cfg *QueueConfig) error {
+	if cfg.Workers > 0 && cfg.BatchVerdicts {
+		return errWorkersWithBatchVerdicts
+	}
+	return nil
+}
+
+// computeQueueFlags ORs the individual QueueFlag bits together into the mask
+// passed to the backend's queue-flags call. Flags are independent bits, so
+// enabling one must never clear another that was already requested.
+func computeQueueFlags(flags []QueueFlag) uint32 {
+	var mask uint32
+	for _, f := range flags {
+		mask |= uint32(f)
+	}
+	return mask
+}
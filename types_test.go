@@ -0,0 +1,72 @@
+/**
+ * @license
+ * Copyright 2018 Telefónica Investigación y Desarrollo, S.A.U
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nfqueue
+
+import "testing"
+
+func TestComputeQueueFlags(t *testing.T) {
+	cases := []struct {
+		name  string
+		flags []QueueFlag
+		want  uint32
+	}{
+		{"empty", nil, 0},
+		{"single", []QueueFlag{Conntrack}, uint32(Conntrack)},
+		{
+			"Conntrack and UIDGid both set",
+			[]QueueFlag{Conntrack, UIDGid},
+			uint32(Conntrack) | uint32(UIDGid),
+		},
+		{
+			"all flags",
+			[]QueueFlag{FailOpen, Conntrack, GSO, UIDGid, Secctx},
+			uint32(FailOpen) | uint32(Conntrack) | uint32(GSO) | uint32(UIDGid) | uint32(Secctx),
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := computeQueueFlags(tc.flags)
+			if got != tc.want {
+				t.Errorf("computeQueueFlags(%v) = %#x, want %#x", tc.flags, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	cases := []struct {
+		name    string
+		cfg     *QueueConfig
+		wantErr bool
+	}{
+		{"neither set", &QueueConfig{}, false},
+		{"workers only", &QueueConfig{Workers: 4}, false},
+		{"batch verdicts only", &QueueConfig{BatchVerdicts: true}, false},
+		{"workers and batch verdicts", &QueueConfig{Workers: 4, BatchVerdicts: true}, true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateConfig(tc.cfg)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("validateConfig(%+v) error = %v, wantErr %v", tc.cfg, err, tc.wantErr)
+			}
+		})
+	}
+}